@@ -1,28 +1,260 @@
 package goose
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"reflect"
+	"strings"
 )
 
+// dbHandle is satisfied by both *sql.DB and *sql.Conn, so the version store
+// and migration runner can operate against whichever one is appropriate: a
+// pooled *sql.DB outside of a migration run, or the single *sql.Conn a
+// dialect's lock is held on during one. Running on the wrong one defeats a
+// connection-scoped lock like sqlite3's (see Sqlite3Dialect.LockSession).
+type dbHandle interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
 // SQLDialect abstracts the details of specific SQL dialects
 // for goose's few SQL specific statements
 type SQLDialect interface {
 	createVersionTableSQL() string // sql string to create the db version table
 	insertVersionSQL() string      // sql string to insert the initial version table row
-	dbVersionQuery(db *sql.DB) (*sql.Rows, error)
+	dbVersionQuery(db dbHandle) (*sql.Rows, error)
 	dbRunAux(db *sql.Tx) error
+
+	// LockSession and UnlockSession take and release a database-level lock
+	// for the duration of a migration run, so that multiple goose instances
+	// (e.g. rolling out the same app on several hosts at once) don't race on
+	// the version table.
+	LockSession(conn *sql.Conn) error
+	UnlockSession(conn *sql.Conn) error
+
+	// SupportsTransactionalDDL reports whether this dialect runs DDL
+	// statements (CREATE TABLE, ALTER TABLE, ...) inside the same
+	// transaction as the rest of a migration. When false, the runner must
+	// commit DDL statements individually and record the version row in its
+	// own short transaction, since a crash mid-migration can't be rolled
+	// back atomically.
+	SupportsTransactionalDDL() bool
+
+	// insertVersionWithChecksumSQL is like insertVersionSQL, but also records
+	// the SHA-256 checksum of the migration file body and the identity that
+	// applied it, so later runs can detect drift with verifyChecksum.
+	insertVersionWithChecksumSQL() string
+
+	// verifyChecksum compares hash against the checksum stored for version,
+	// returning an error if a previously-applied migration's file has since
+	// been edited.
+	verifyChecksum(db dbHandle, version int64, hash string) error
+
+	// deleteVersionSQL is the sql string to remove a previously recorded
+	// version row, e.g. when a migration is rolled back.
+	deleteVersionSQL() string
+}
+
+// VersionStore abstracts how goose persists and queries migration history,
+// independent of the SQL dialect used to write individual migrations. The
+// default, TableVersionStore, backs it with a database table; other
+// implementations can back it with anything else.
+type VersionStore interface {
+	// EnsureExists creates the version store's backing storage if it
+	// doesn't already exist.
+	EnsureExists(db dbHandle) error
+	// Insert records version as applied (or not), along with the checksum
+	// of the migration file and the identity that applied it.
+	Insert(db dbHandle, version int64, applied bool, checksum, appliedBy string) error
+	// Delete removes a previously recorded version.
+	Delete(db dbHandle, version int64) error
+	// List returns all recorded versions, most recent first.
+	List(db dbHandle) (*sql.Rows, error)
+	// Current returns the most recently applied version.
+	Current(db dbHandle) (int64, error)
+	// VerifyChecksum checks a previously-applied version's stored checksum
+	// against hash, so drift in committed migration files can be detected.
+	VerifyChecksum(db dbHandle, version int64, hash string) error
+}
+
+// TableVersionStore is goose's default VersionStore: migration history lives
+// in a database table whose DDL and DML are provided by Dialect.
+type TableVersionStore struct {
+	Dialect SQLDialect
+}
+
+// EnsureExists implements VersionStore. It probes for the table with the
+// same query Current/List use rather than a dialect-specific catalog lookup,
+// since a few of goose's supported dialects (MSSQL, Oracle) don't support
+// "CREATE TABLE IF NOT EXISTS".
+func (t TableVersionStore) EnsureExists(db dbHandle) error {
+	if rows, err := t.Dialect.dbVersionQuery(db); err == nil {
+		rows.Close()
+		return nil
+	}
+
+	_, err := db.ExecContext(context.Background(), t.Dialect.createVersionTableSQL())
+	return err
+}
+
+// Insert implements VersionStore.
+func (t TableVersionStore) Insert(db dbHandle, version int64, applied bool, checksum, appliedBy string) error {
+	_, err := db.ExecContext(context.Background(), t.Dialect.insertVersionWithChecksumSQL(), version, applied, checksum, appliedBy)
+	return err
+}
+
+// Delete implements VersionStore.
+func (t TableVersionStore) Delete(db dbHandle, version int64) error {
+	_, err := db.ExecContext(context.Background(), t.Dialect.deleteVersionSQL(), version)
+	return err
+}
+
+// List implements VersionStore.
+func (t TableVersionStore) List(db dbHandle) (*sql.Rows, error) {
+	return t.Dialect.dbVersionQuery(db)
+}
+
+// Current implements VersionStore.
+func (t TableVersionStore) Current(db dbHandle) (int64, error) {
+	rows, err := t.Dialect.dbVersionQuery(db)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var version int64
+		var applied bool
+		if err := rows.Scan(&version, &applied); err != nil {
+			return 0, err
+		}
+		if applied {
+			return version, nil
+		}
+	}
+
+	return 0, rows.Err()
+}
+
+// VerifyChecksum implements VersionStore.
+func (t TableVersionStore) VerifyChecksum(db dbHandle, version int64, hash string) error {
+	return t.Dialect.verifyChecksum(db, version, hash)
+}
+
+var store VersionStore = TableVersionStore{Dialect: dialect}
+
+// GetVersionStore gets the VersionStore goose uses to record migration
+// history.
+func GetVersionStore() VersionStore {
+	return store
+}
+
+// SetVersionStore overrides the VersionStore goose uses to record migration
+// history, e.g. to back it with something other than a database table.
+func SetVersionStore(s VersionStore) {
+	store = s
+}
+
+// verifyStoredChecksum looks up the checksum recorded for version using the
+// given positional placeholder syntax and applied-row predicate, then
+// compares it against hash. It's shared by every dialect's verifyChecksum so
+// the drift-detection semantics stay identical across all of them; each
+// dialect passes its own appliedExpr because is_applied isn't a bare boolean
+// expression everywhere (e.g. Oracle's CHAR(1) and MSSQL's BIT both need an
+// explicit comparison), and its own table, the dialect's fully-quoted table
+// reference (e.g. "[goose_db_version]" for MSSQL), so the lookup matches the
+// quoting every other statement in that dialect uses.
+func verifyStoredChecksum(db dbHandle, version int64, hash, table, placeholder, appliedExpr string) error {
+	var stored sql.NullString
+	query := fmt.Sprintf("SELECT checksum FROM %s WHERE version_id = %s AND %s", table, placeholder, appliedExpr)
+	if err := db.QueryRowContext(context.Background(), query, version).Scan(&stored); err != nil {
+		return err
+	}
+	if stored.Valid && stored.String != "" && stored.String != hash {
+		return fmt.Errorf("goose: migration %d has been modified since it was applied (checksum mismatch)", version)
+	}
+	return nil
+}
+
+// sessionRollbacker is implemented by dialects whose LockSession holds an
+// open transaction on conn for the duration of a migration run (currently
+// only Sqlite3Dialect's BEGIN IMMEDIATE fallback). RunWithLock uses it to
+// roll back instead of committing when fn fails, so a half-applied migration
+// can't slip through on UnlockSession's otherwise unconditional commit.
+type sessionRollbacker interface {
+	RollbackSession(conn *sql.Conn) error
+}
+
+// RunWithLock runs fn while holding the current dialect's session lock,
+// releasing it once fn returns. The Up/Down migration runners call this to
+// serialize concurrent goose processes against the same database, and must
+// do all of their work through the conn fn receives rather than the original
+// db: for a dialect like sqlite3, whose lock is a transaction held open on
+// that one connection, any work done on a different pooled connection would
+// block behind it and deadlock the very run the lock is meant to protect.
+func RunWithLock(db *sql.DB, fn func(conn *sql.Conn) error) error {
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := dialect.LockSession(conn); err != nil {
+		return fmt.Errorf("goose: could not acquire migration lock: %w", err)
+	}
+
+	fnErr := fn(conn)
+
+	if fnErr != nil {
+		if rb, ok := dialect.(sessionRollbacker); ok {
+			if err := rb.RollbackSession(conn); err != nil {
+				return fmt.Errorf("%w (rollback also failed: %v)", fnErr, err)
+			}
+			return fnErr
+		}
+	}
+
+	if err := dialect.UnlockSession(conn); err != nil {
+		if fnErr != nil {
+			return fnErr
+		}
+		return fmt.Errorf("goose: could not release migration lock: %w", err)
+	}
+
+	return fnErr
 }
 
 var dialect SQLDialect = &PostgresDialect{}
 
+// customDialects holds dialects registered via RegisterDialect, keyed by the
+// name they're selected under with SetDialect.
+var customDialects = map[string]SQLDialect{}
+
+// RegisterDialect makes a custom SQLDialect available under name, so it can
+// be selected with SetDialect(name) without patching goose itself. This is
+// the extension point for dialects goose doesn't ship with, e.g. ClickHouse
+// or Snowflake.
+func RegisterDialect(name string, d SQLDialect) {
+	customDialects[name] = d
+}
+
 // GetDialect gets the SQLDialect
 func GetDialect() SQLDialect {
 	return dialect
 }
 
-// SetDialect sets the SQLDialect
+// SetDialect sets the SQLDialect by name. Names registered with
+// RegisterDialect take precedence over goose's built-in dialects.
 func SetDialect(d string) error {
+	if custom, ok := customDialects[d]; ok {
+		dialect = custom
+		store = TableVersionStore{Dialect: dialect}
+		return nil
+	}
+
 	switch d {
 	case "postgres":
 		dialect = &PostgresDialect{}
@@ -36,13 +268,56 @@ func SetDialect(d string) error {
 		dialect = &TiDBDialect{}
 	case "oracle":
 		dialect = &OracleDialect{}
+	case "mssql", "sqlserver":
+		dialect = &MSSQLDialect{}
+	case "cockroach", "crdb":
+		dialect = &CockroachDialect{}
 	default:
 		return fmt.Errorf("%q: unknown dialect", d)
 	}
 
+	store = TableVersionStore{Dialect: dialect}
 	return nil
 }
 
+// SetDialectInstance sets the SQLDialect directly to d, bypassing the
+// name-based lookup SetDialect does. Useful for a dialect instance that
+// carries its own state (e.g. connection-specific quoting) rather than one
+// that can be selected purely by name.
+func SetDialectInstance(d SQLDialect) {
+	dialect = d
+	store = TableVersionStore{Dialect: dialect}
+}
+
+// DetectDialect inspects db's underlying driver and returns the goose dialect
+// name it corresponds to, so callers don't have to hard-code the name. It
+// recognizes goose's built-in driver/dialect pairings as well as any name
+// registered with RegisterDialect whose name appears in the driver's type.
+func DetectDialect(db *sql.DB) (string, error) {
+	driverType := strings.TrimPrefix(reflect.TypeOf(db.Driver()).String(), "*")
+
+	switch {
+	case strings.Contains(driverType, "pq."), strings.Contains(driverType, "pgx"):
+		return "postgres", nil
+	case strings.Contains(driverType, "mysql"):
+		return "mysql", nil
+	case strings.Contains(driverType, "sqlite3"):
+		return "sqlite3", nil
+	case strings.Contains(driverType, "godror"), strings.Contains(driverType, "goracle"):
+		return "oracle", nil
+	case strings.Contains(driverType, "mssql"):
+		return "mssql", nil
+	}
+
+	for name := range customDialects {
+		if strings.Contains(strings.ToLower(driverType), strings.ToLower(name)) {
+			return name, nil
+		}
+	}
+
+	return "", fmt.Errorf("could not detect dialect for driver %q: register one with RegisterDialect or call SetDialect explicitly", driverType)
+}
+
 ////////////////////////////
 // Postgres
 ////////////////////////////
@@ -60,6 +335,8 @@ func (pg PostgresDialect) createVersionTableSQL() string {
                 version_id bigint NOT NULL,
                 is_applied boolean NOT NULL,
                 tstamp timestamp NULL default now(),
+                checksum CHAR(64),
+                applied_by VARCHAR(128),
                 PRIMARY KEY(id)
             );`, TableName())
 }
@@ -68,8 +345,20 @@ func (pg PostgresDialect) insertVersionSQL() string {
 	return fmt.Sprintf("INSERT INTO %s (version_id, is_applied) VALUES ($1, $2);", TableName())
 }
 
-func (pg PostgresDialect) dbVersionQuery(db *sql.DB) (*sql.Rows, error) {
-	rows, err := db.Query(fmt.Sprintf("SELECT version_id, is_applied from %s ORDER BY id DESC", TableName()))
+func (pg PostgresDialect) insertVersionWithChecksumSQL() string {
+	return fmt.Sprintf("INSERT INTO %s (version_id, is_applied, checksum, applied_by) VALUES ($1, $2, $3, $4);", TableName())
+}
+
+func (pg PostgresDialect) verifyChecksum(db dbHandle, version int64, hash string) error {
+	return verifyStoredChecksum(db, version, hash, TableName(), "$1", "is_applied = true")
+}
+
+func (pg PostgresDialect) deleteVersionSQL() string {
+	return fmt.Sprintf("DELETE FROM %s WHERE version_id=$1;", TableName())
+}
+
+func (pg PostgresDialect) dbVersionQuery(db dbHandle) (*sql.Rows, error) {
+	rows, err := db.QueryContext(context.Background(), fmt.Sprintf("SELECT version_id, is_applied from %s ORDER BY id DESC", TableName()))
 	if err != nil {
 		return nil, err
 	}
@@ -77,6 +366,20 @@ func (pg PostgresDialect) dbVersionQuery(db *sql.DB) (*sql.Rows, error) {
 	return rows, err
 }
 
+func (pg PostgresDialect) LockSession(conn *sql.Conn) error {
+	_, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_lock(hashtext('goose'))")
+	return err
+}
+
+func (pg PostgresDialect) UnlockSession(conn *sql.Conn) error {
+	_, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock(hashtext('goose'))")
+	return err
+}
+
+func (pg PostgresDialect) SupportsTransactionalDDL() bool {
+	return true
+}
+
 ////////////////////////////
 // MySQL
 ////////////////////////////
@@ -94,6 +397,8 @@ func (m MySQLDialect) createVersionTableSQL() string {
                 version_id bigint NOT NULL,
                 is_applied boolean NOT NULL,
                 tstamp timestamp NULL default now(),
+                checksum CHAR(64),
+                applied_by VARCHAR(128),
                 PRIMARY KEY(id)
             );`, TableName())
 }
@@ -102,8 +407,20 @@ func (m MySQLDialect) insertVersionSQL() string {
 	return fmt.Sprintf("INSERT INTO %s (version_id, is_applied) VALUES (?, ?);", TableName())
 }
 
-func (m MySQLDialect) dbVersionQuery(db *sql.DB) (*sql.Rows, error) {
-	rows, err := db.Query(fmt.Sprintf("SELECT version_id, is_applied from %s ORDER BY id DESC", TableName()))
+func (m MySQLDialect) insertVersionWithChecksumSQL() string {
+	return fmt.Sprintf("INSERT INTO %s (version_id, is_applied, checksum, applied_by) VALUES (?, ?, ?, ?);", TableName())
+}
+
+func (m MySQLDialect) verifyChecksum(db dbHandle, version int64, hash string) error {
+	return verifyStoredChecksum(db, version, hash, TableName(), "?", "is_applied = 1")
+}
+
+func (m MySQLDialect) deleteVersionSQL() string {
+	return fmt.Sprintf("DELETE FROM %s WHERE version_id=?;", TableName())
+}
+
+func (m MySQLDialect) dbVersionQuery(db dbHandle) (*sql.Rows, error) {
+	rows, err := db.QueryContext(context.Background(), fmt.Sprintf("SELECT version_id, is_applied from %s ORDER BY id DESC", TableName()))
 	if err != nil {
 		return nil, err
 	}
@@ -111,6 +428,29 @@ func (m MySQLDialect) dbVersionQuery(db *sql.DB) (*sql.Rows, error) {
 	return rows, err
 }
 
+func (m MySQLDialect) LockSession(conn *sql.Conn) error {
+	var got int
+	if err := conn.QueryRowContext(context.Background(), "SELECT GET_LOCK('goose', 10)").Scan(&got); err != nil {
+		return err
+	}
+	if got != 1 {
+		return fmt.Errorf("goose: timed out acquiring MySQL advisory lock %q", "goose")
+	}
+	return nil
+}
+
+func (m MySQLDialect) UnlockSession(conn *sql.Conn) error {
+	_, err := conn.ExecContext(context.Background(), "SELECT RELEASE_LOCK('goose')")
+	return err
+}
+
+// SupportsTransactionalDDL is false: MySQL implicitly commits any open
+// transaction before running DDL, so DDL can't be rolled back with the rest
+// of a migration.
+func (m MySQLDialect) SupportsTransactionalDDL() bool {
+	return false
+}
+
 ////////////////////////////
 // sqlite3
 ////////////////////////////
@@ -127,7 +467,9 @@ func (m Sqlite3Dialect) createVersionTableSQL() string {
                 id INTEGER PRIMARY KEY AUTOINCREMENT,
                 version_id INTEGER NOT NULL,
                 is_applied INTEGER NOT NULL,
-                tstamp TIMESTAMP DEFAULT (datetime('now'))
+                tstamp TIMESTAMP DEFAULT (datetime('now')),
+                checksum CHAR(64),
+                applied_by VARCHAR(128)
             );`, TableName())
 }
 
@@ -135,8 +477,20 @@ func (m Sqlite3Dialect) insertVersionSQL() string {
 	return fmt.Sprintf("INSERT INTO %s (version_id, is_applied) VALUES (?, ?);", TableName())
 }
 
-func (m Sqlite3Dialect) dbVersionQuery(db *sql.DB) (*sql.Rows, error) {
-	rows, err := db.Query(fmt.Sprintf("SELECT version_id, is_applied from %s ORDER BY id DESC", TableName()))
+func (m Sqlite3Dialect) insertVersionWithChecksumSQL() string {
+	return fmt.Sprintf("INSERT INTO %s (version_id, is_applied, checksum, applied_by) VALUES (?, ?, ?, ?);", TableName())
+}
+
+func (m Sqlite3Dialect) verifyChecksum(db dbHandle, version int64, hash string) error {
+	return verifyStoredChecksum(db, version, hash, TableName(), "?", "is_applied = 1")
+}
+
+func (m Sqlite3Dialect) deleteVersionSQL() string {
+	return fmt.Sprintf("DELETE FROM %s WHERE version_id=?;", TableName())
+}
+
+func (m Sqlite3Dialect) dbVersionQuery(db dbHandle) (*sql.Rows, error) {
+	rows, err := db.QueryContext(context.Background(), fmt.Sprintf("SELECT version_id, is_applied from %s ORDER BY id DESC", TableName()))
 	if err != nil {
 		return nil, err
 	}
@@ -144,6 +498,37 @@ func (m Sqlite3Dialect) dbVersionQuery(db *sql.DB) (*sql.Rows, error) {
 	return rows, err
 }
 
+// LockSession has no equivalent to a session-level advisory lock in SQLite,
+// so it falls back to holding a write transaction open (BEGIN IMMEDIATE)
+// with a sentinel row in the version table for visibility.
+func (m Sqlite3Dialect) LockSession(conn *sql.Conn) error {
+	ctx := context.Background()
+	if _, err := conn.ExecContext(ctx, "BEGIN IMMEDIATE"); err != nil {
+		return err
+	}
+	_, err := conn.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s (version_id, is_applied) VALUES (-1, 0)", TableName()))
+	return err
+}
+
+func (m Sqlite3Dialect) UnlockSession(conn *sql.Conn) error {
+	ctx := context.Background()
+	_, _ = conn.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE version_id = -1", TableName()))
+	_, err := conn.ExecContext(ctx, "COMMIT")
+	return err
+}
+
+// RollbackSession implements sessionRollbacker: since LockSession's BEGIN
+// IMMEDIATE is still open, a failed run rolls it back instead of committing,
+// so a migration that errored partway through doesn't get persisted anyway.
+func (m Sqlite3Dialect) RollbackSession(conn *sql.Conn) error {
+	_, err := conn.ExecContext(context.Background(), "ROLLBACK")
+	return err
+}
+
+func (m Sqlite3Dialect) SupportsTransactionalDDL() bool {
+	return true
+}
+
 ////////////////////////////
 // Redshift
 ////////////////////////////
@@ -161,6 +546,8 @@ func (rs RedshiftDialect) createVersionTableSQL() string {
                 version_id bigint NOT NULL,
                 is_applied boolean NOT NULL,
                 tstamp timestamp NULL default sysdate,
+                checksum CHAR(64),
+                applied_by VARCHAR(128),
                 PRIMARY KEY(id)
             );`, TableName())
 }
@@ -169,8 +556,20 @@ func (rs RedshiftDialect) insertVersionSQL() string {
 	return fmt.Sprintf("INSERT INTO %s (version_id, is_applied) VALUES ($1, $2);", TableName())
 }
 
-func (rs RedshiftDialect) dbVersionQuery(db *sql.DB) (*sql.Rows, error) {
-	rows, err := db.Query(fmt.Sprintf("SELECT version_id, is_applied from %s ORDER BY id DESC", TableName()))
+func (rs RedshiftDialect) insertVersionWithChecksumSQL() string {
+	return fmt.Sprintf("INSERT INTO %s (version_id, is_applied, checksum, applied_by) VALUES ($1, $2, $3, $4);", TableName())
+}
+
+func (rs RedshiftDialect) verifyChecksum(db dbHandle, version int64, hash string) error {
+	return verifyStoredChecksum(db, version, hash, TableName(), "$1", "is_applied = true")
+}
+
+func (rs RedshiftDialect) deleteVersionSQL() string {
+	return fmt.Sprintf("DELETE FROM %s WHERE version_id=$1;", TableName())
+}
+
+func (rs RedshiftDialect) dbVersionQuery(db dbHandle) (*sql.Rows, error) {
+	rows, err := db.QueryContext(context.Background(), fmt.Sprintf("SELECT version_id, is_applied from %s ORDER BY id DESC", TableName()))
 	if err != nil {
 		return nil, err
 	}
@@ -178,6 +577,23 @@ func (rs RedshiftDialect) dbVersionQuery(db *sql.DB) (*sql.Rows, error) {
 	return rows, err
 }
 
+func (rs RedshiftDialect) LockSession(conn *sql.Conn) error {
+	_, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_lock(hashtext('goose'))")
+	return err
+}
+
+func (rs RedshiftDialect) UnlockSession(conn *sql.Conn) error {
+	_, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock(hashtext('goose'))")
+	return err
+}
+
+// SupportsTransactionalDDL is false: Redshift only rolls back a subset of DDL
+// inside a transaction (e.g. CREATE TABLE is, ALTER TABLE often isn't), so
+// goose treats it conservatively as non-transactional.
+func (rs RedshiftDialect) SupportsTransactionalDDL() bool {
+	return false
+}
+
 ////////////////////////////
 // TiDB
 ////////////////////////////
@@ -195,6 +611,8 @@ func (m TiDBDialect) createVersionTableSQL() string {
                 version_id bigint NOT NULL,
                 is_applied boolean NOT NULL,
                 tstamp timestamp NULL default now(),
+                checksum CHAR(64),
+                applied_by VARCHAR(128),
                 PRIMARY KEY(id)
             );`, TableName())
 }
@@ -203,8 +621,20 @@ func (m TiDBDialect) insertVersionSQL() string {
 	return fmt.Sprintf("INSERT INTO %s (version_id, is_applied) VALUES (?, ?);", TableName())
 }
 
-func (m TiDBDialect) dbVersionQuery(db *sql.DB) (*sql.Rows, error) {
-	rows, err := db.Query(fmt.Sprintf("SELECT version_id, is_applied from %s ORDER BY id DESC", TableName()))
+func (m TiDBDialect) insertVersionWithChecksumSQL() string {
+	return fmt.Sprintf("INSERT INTO %s (version_id, is_applied, checksum, applied_by) VALUES (?, ?, ?, ?);", TableName())
+}
+
+func (m TiDBDialect) verifyChecksum(db dbHandle, version int64, hash string) error {
+	return verifyStoredChecksum(db, version, hash, TableName(), "?", "is_applied = 1")
+}
+
+func (m TiDBDialect) deleteVersionSQL() string {
+	return fmt.Sprintf("DELETE FROM %s WHERE version_id=?;", TableName())
+}
+
+func (m TiDBDialect) dbVersionQuery(db dbHandle) (*sql.Rows, error) {
+	rows, err := db.QueryContext(context.Background(), fmt.Sprintf("SELECT version_id, is_applied from %s ORDER BY id DESC", TableName()))
 	if err != nil {
 		return nil, err
 	}
@@ -212,6 +642,26 @@ func (m TiDBDialect) dbVersionQuery(db *sql.DB) (*sql.Rows, error) {
 	return rows, err
 }
 
+func (m TiDBDialect) LockSession(conn *sql.Conn) error {
+	var got int
+	if err := conn.QueryRowContext(context.Background(), "SELECT GET_LOCK('goose', 10)").Scan(&got); err != nil {
+		return err
+	}
+	if got != 1 {
+		return fmt.Errorf("goose: timed out acquiring TiDB advisory lock %q", "goose")
+	}
+	return nil
+}
+
+func (m TiDBDialect) UnlockSession(conn *sql.Conn) error {
+	_, err := conn.ExecContext(context.Background(), "SELECT RELEASE_LOCK('goose')")
+	return err
+}
+
+func (m TiDBDialect) SupportsTransactionalDDL() bool {
+	return false
+}
+
 ////////////////////////////
 // Oracle
 ////////////////////////////
@@ -222,11 +672,11 @@ type OracleDialect struct{}
 func (OracleDialect) dbRunAux(db *sql.Tx) error {
 	_, err := db.Exec(fmt.Sprintf(`ALTER TABLE "%s" ADD PRIMARY KEY ("ID")`, TableName()))
 	if err != nil {
-		println("error on create PK: %s", err.Error())
+		return fmt.Errorf("error on create PK: %w", err)
 	}
 	_, err = db.Exec(fmt.Sprintf(`CREATE SEQUENCE %s_id_seq`, TableName()))
 	if err != nil {
-		println("error on create SEQ: %s", err.Error())
+		return fmt.Errorf("error on create SEQ: %w", err)
 	}
 
 	var trigger = fmt.Sprintf(`
@@ -243,7 +693,7 @@ func (OracleDialect) dbRunAux(db *sql.Tx) error {
 
 	_, err = db.Exec(trigger)
 	if err != nil {
-		println("error on create Trigger: %s", err.Error())
+		return fmt.Errorf("error on create Trigger: %w", err)
 	}
 	return nil
 }
@@ -254,7 +704,9 @@ func (OracleDialect) createVersionTableSQL() string {
                 id NUMBER(19),
                 version_id NUMBER(19) NOT NULL,
                 is_applied char(1) NOT NULL,
-                tstamp TIMESTAMP(6) default SYS_EXTRACT_UTC(SYSTIMESTAMP)
+                tstamp TIMESTAMP(6) default SYS_EXTRACT_UTC(SYSTIMESTAMP),
+                checksum CHAR(64),
+                applied_by VARCHAR2(128)
             )`, TableName())
 	return command
 }
@@ -263,11 +715,176 @@ func (OracleDialect) insertVersionSQL() string {
 	return fmt.Sprintf(`INSERT INTO %s (version_id, is_applied) VALUES (?, ?)`, TableName())
 }
 
-func (OracleDialect) dbVersionQuery(db *sql.DB) (*sql.Rows, error) {
-	rows, err := db.Query(fmt.Sprintf(`SELECT version_id, is_applied from %s ORDER BY id DESC`, TableName()))
+func (OracleDialect) insertVersionWithChecksumSQL() string {
+	return fmt.Sprintf(`INSERT INTO %s (version_id, is_applied, checksum, applied_by) VALUES (?, ?, ?, ?)`, TableName())
+}
+
+func (OracleDialect) verifyChecksum(db dbHandle, version int64, hash string) error {
+	return verifyStoredChecksum(db, version, hash, TableName(), "?", "is_applied = '1'")
+}
+
+func (OracleDialect) deleteVersionSQL() string {
+	return fmt.Sprintf(`DELETE FROM %s WHERE version_id=?`, TableName())
+}
+
+func (OracleDialect) dbVersionQuery(db dbHandle) (*sql.Rows, error) {
+	rows, err := db.QueryContext(context.Background(), fmt.Sprintf(`SELECT version_id, is_applied from %s ORDER BY id DESC`, TableName()))
+	if err != nil {
+		return nil, err
+	}
+
+	return rows, err
+}
+
+func (OracleDialect) LockSession(conn *sql.Conn) error {
+	_, err := conn.ExecContext(context.Background(), `BEGIN DBMS_LOCK.REQUEST(DBMS_LOCK.ALLOCATE_UNIQUE('goose'), DBMS_LOCK.X_MODE); END;`)
+	return err
+}
+
+func (OracleDialect) UnlockSession(conn *sql.Conn) error {
+	_, err := conn.ExecContext(context.Background(), `BEGIN DBMS_LOCK.RELEASE(DBMS_LOCK.ALLOCATE_UNIQUE('goose')); END;`)
+	return err
+}
+
+func (OracleDialect) SupportsTransactionalDDL() bool {
+	return false
+}
+
+////////////////////////////
+// MSSQL
+////////////////////////////
+
+// MSSQLDialect struct.
+type MSSQLDialect struct{}
+
+func (m MSSQLDialect) dbRunAux(db *sql.Tx) error {
+	return nil
+}
+
+func (m MSSQLDialect) createVersionTableSQL() string {
+	return fmt.Sprintf(`CREATE TABLE [%s] (
+                id INT IDENTITY(1,1) NOT NULL,
+                version_id BIGINT NOT NULL,
+                is_applied BIT NOT NULL,
+                tstamp DATETIME2 NULL DEFAULT GETUTCDATE(),
+                checksum CHAR(64),
+                applied_by VARCHAR(128),
+                PRIMARY KEY(id)
+            );`, TableName())
+}
+
+func (m MSSQLDialect) insertVersionSQL() string {
+	return fmt.Sprintf("INSERT INTO [%s] (version_id, is_applied) VALUES (@p1, @p2);", TableName())
+}
+
+func (m MSSQLDialect) insertVersionWithChecksumSQL() string {
+	return fmt.Sprintf("INSERT INTO [%s] (version_id, is_applied, checksum, applied_by) VALUES (@p1, @p2, @p3, @p4);", TableName())
+}
+
+func (m MSSQLDialect) dbVersionQuery(db dbHandle) (*sql.Rows, error) {
+	rows, err := db.QueryContext(context.Background(), fmt.Sprintf("SELECT version_id, is_applied FROM [%s] ORDER BY id DESC", TableName()))
 	if err != nil {
 		return nil, err
 	}
 
 	return rows, err
 }
+
+func (m MSSQLDialect) verifyChecksum(db dbHandle, version int64, hash string) error {
+	return verifyStoredChecksum(db, version, hash, fmt.Sprintf("[%s]", TableName()), "@p1", "is_applied = 1")
+}
+
+func (m MSSQLDialect) deleteVersionSQL() string {
+	return fmt.Sprintf("DELETE FROM [%s] WHERE version_id=@p1;", TableName())
+}
+
+// LockSession requests a Session-owned applock: the default, Transaction,
+// requires an open transaction on conn to hold the lock against, which
+// nothing here opens.
+func (m MSSQLDialect) LockSession(conn *sql.Conn) error {
+	_, err := conn.ExecContext(context.Background(), "EXEC sp_getapplock @Resource = 'goose', @LockMode = 'Exclusive', @LockOwner = 'Session'")
+	return err
+}
+
+func (m MSSQLDialect) UnlockSession(conn *sql.Conn) error {
+	_, err := conn.ExecContext(context.Background(), "EXEC sp_releaseapplock @Resource = 'goose', @LockOwner = 'Session'")
+	return err
+}
+
+func (m MSSQLDialect) SupportsTransactionalDDL() bool {
+	return true
+}
+
+////////////////////////////
+// CockroachDB
+////////////////////////////
+
+// CockroachDialect struct.
+type CockroachDialect struct{}
+
+// dbRunAux enables temp tables, which Cockroach keeps behind a session
+// setting.
+func (c CockroachDialect) dbRunAux(db *sql.Tx) error {
+	_, err := db.Exec("SET experimental_enable_temp_tables = true")
+	return err
+}
+
+func (c CockroachDialect) createVersionTableSQL() string {
+	return fmt.Sprintf(`CREATE TABLE %s (
+            	id INT DEFAULT unique_rowid(),
+                version_id bigint NOT NULL,
+                is_applied boolean NOT NULL,
+                tstamp timestamp NULL default now(),
+                checksum CHAR(64),
+                applied_by VARCHAR(128),
+                PRIMARY KEY(id)
+            );`, TableName())
+}
+
+func (c CockroachDialect) insertVersionSQL() string {
+	return fmt.Sprintf("INSERT INTO %s (version_id, is_applied) VALUES ($1, $2);", TableName())
+}
+
+func (c CockroachDialect) insertVersionWithChecksumSQL() string {
+	return fmt.Sprintf("INSERT INTO %s (version_id, is_applied, checksum, applied_by) VALUES ($1, $2, $3, $4);", TableName())
+}
+
+func (c CockroachDialect) dbVersionQuery(db dbHandle) (*sql.Rows, error) {
+	rows, err := db.QueryContext(context.Background(), fmt.Sprintf("SELECT version_id, is_applied from %s ORDER BY id DESC", TableName()))
+	if err != nil {
+		return nil, err
+	}
+
+	return rows, err
+}
+
+func (c CockroachDialect) verifyChecksum(db dbHandle, version int64, hash string) error {
+	return verifyStoredChecksum(db, version, hash, TableName(), "$1", "is_applied = true")
+}
+
+func (c CockroachDialect) deleteVersionSQL() string {
+	return fmt.Sprintf("DELETE FROM %s WHERE version_id=$1;", TableName())
+}
+
+func (c CockroachDialect) LockSession(conn *sql.Conn) error {
+	_, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_lock(hashtext('goose'))")
+	return err
+}
+
+func (c CockroachDialect) UnlockSession(conn *sql.Conn) error {
+	_, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock(hashtext('goose'))")
+	return err
+}
+
+func (c CockroachDialect) SupportsTransactionalDDL() bool {
+	return true
+}
+
+// IsRetryableError reports whether err is a CockroachDB serialization failure
+// (SQLSTATE 40001). Cockroach's SERIALIZABLE isolation model can abort a
+// transaction under contention even when it would otherwise succeed, so the
+// runner should retry the whole migration transaction when this returns true
+// rather than treating it as a hard failure.
+func (c CockroachDialect) IsRetryableError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "40001")
+}
@@ -0,0 +1,357 @@
+package goose
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Strict makes Up and Status treat checksum drift on a previously-applied
+// migration as a hard error instead of a warning. It's the package-level
+// equivalent of a goose CLI --strict flag.
+var Strict = false
+
+// migrationNamePattern matches the version prefix goose expects migration
+// files to start with, e.g. "00001_create_users_table.sql".
+var migrationNamePattern = regexp.MustCompile(`^(\d+)_.*\.sql$`)
+
+// migrationFile pairs a migration's version with the file it was loaded
+// from and the SHA-256 checksum of its body.
+type migrationFile struct {
+	Version  int64
+	Source   string
+	Checksum string
+}
+
+// collectMigrationFiles walks dir for goose SQL migrations, in ascending
+// version order, hashing each file's body as it goes.
+func collectMigrationFiles(dir string) ([]migrationFile, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []migrationFile
+	for _, entry := range entries {
+		match := migrationNamePattern.FindStringSubmatch(entry.Name())
+		if match == nil {
+			continue
+		}
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("goose: invalid version in migration filename %q: %w", entry.Name(), err)
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		body, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(body)
+
+		files = append(files, migrationFile{
+			Version:  version,
+			Source:   path,
+			Checksum: hex.EncodeToString(sum[:]),
+		})
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].Version < files[j].Version })
+	return files, nil
+}
+
+// checkDrift verifies f's on-disk checksum against the one recorded for it,
+// returning an error under Strict and otherwise just printing a warning.
+func checkDrift(db dbHandle, f migrationFile) error {
+	err := store.VerifyChecksum(db, f.Version, f.Checksum)
+	if err == nil {
+		return nil
+	}
+	if Strict {
+		return err
+	}
+	fmt.Printf("goose: warning: %v\n", err)
+	return nil
+}
+
+// upStatements extracts the statements under "-- +goose Up" from a
+// migration file's body.
+func upStatements(body string) []string {
+	return sectionStatements(body, "-- +goose Up", "-- +goose Down")
+}
+
+// downStatements extracts the statements under "-- +goose Down" from a
+// migration file's body.
+func downStatements(body string) []string {
+	return sectionStatements(body, "-- +goose Down", "")
+}
+
+func sectionStatements(body, startMarker, endMarker string) []string {
+	start := strings.Index(body, startMarker)
+	if start == -1 {
+		return nil
+	}
+	section := body[start+len(startMarker):]
+	if endMarker != "" {
+		if end := strings.Index(section, endMarker); end != -1 {
+			section = section[:end]
+		}
+	}
+
+	var statements []string
+	for _, stmt := range strings.Split(section, ";") {
+		stmt = strings.TrimSpace(stmt)
+		if stmt != "" {
+			statements = append(statements, stmt)
+		}
+	}
+	return statements
+}
+
+// appliedByIdentity identifies whoever is running this process, to record in
+// the version table's applied_by column. It falls back to whatever it can
+// get rather than erroring, since failing a migration over this would be
+// worse than recording an incomplete identity.
+func appliedByIdentity() string {
+	host, _ := os.Hostname()
+	if host == "" {
+		host = "unknown"
+	}
+
+	u, err := user.Current()
+	if err != nil || u.Username == "" {
+		return host
+	}
+	return fmt.Sprintf("%s@%s", u.Username, host)
+}
+
+// isDDL reports whether statement is schema-altering DDL rather than DML.
+// The check is intentionally broad so that, on dialects where DDL can't be
+// rolled back, anything that looks schema-altering takes the safer
+// individually-committed path rather than risking a dialect-specific miss.
+func isDDL(statement string) bool {
+	s := strings.ToUpper(strings.TrimSpace(statement))
+	for _, prefix := range []string{"CREATE", "ALTER", "DROP", "TRUNCATE"} {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// retryableDialect is implemented by dialects whose isolation model can
+// abort a transaction under contention even though it would otherwise
+// succeed (currently only CockroachDialect, for SQLSTATE 40001). The runner
+// retries such errors instead of failing the migration outright.
+type retryableDialect interface {
+	IsRetryableError(err error) bool
+}
+
+// maxMigrationRetries bounds how many times the runner retries a migration
+// statement that failed with a retryableDialect error before giving up.
+const maxMigrationRetries = 3
+
+// runMigrationStatementsWithRetry wraps runMigrationStatements, retrying it
+// up to maxMigrationRetries times when the current dialect reports the
+// failure as retryable (e.g. CockroachDB's serialization failures).
+func runMigrationStatementsWithRetry(db dbHandle, statements []string) error {
+	rd, retryable := dialect.(retryableDialect)
+
+	var err error
+	for attempt := 0; attempt <= maxMigrationRetries; attempt++ {
+		err = runMigrationStatements(db, statements)
+		if err == nil || !retryable || !rd.IsRetryableError(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// runMigrationStatements runs statements against db, honoring the current
+// dialect's SupportsTransactionalDDL. When true, the whole migration runs in
+// one transaction. When false, DDL statements are committed individually
+// and DML statements each get their own short transaction, so a crash
+// mid-migration on a dialect like MySQL or Oracle (which implicitly commits
+// on DDL anyway) leaves a recoverable state instead of a silently
+// half-applied migration.
+//
+// If the current dialect's lock already holds an open transaction on db
+// (only sqlite3's BEGIN IMMEDIATE fallback does this, via sessionRollbacker),
+// statements run directly against it instead of nesting another transaction
+// inside it; RunWithLock commits or rolls back that outer transaction once
+// the whole run finishes.
+func runMigrationStatements(db dbHandle, statements []string) error {
+	ctx := context.Background()
+
+	if _, lockHoldsTx := dialect.(sessionRollbacker); lockHoldsTx {
+		for _, stmt := range statements {
+			if _, err := db.ExecContext(ctx, stmt); err != nil {
+				return fmt.Errorf("goose: migration statement failed: %w", err)
+			}
+		}
+		return nil
+	}
+
+	if dialect.SupportsTransactionalDDL() {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		for _, stmt := range statements {
+			if _, err := tx.Exec(stmt); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("goose: migration statement failed: %w", err)
+			}
+		}
+		return tx.Commit()
+	}
+
+	for _, stmt := range statements {
+		if isDDL(stmt) {
+			if _, err := db.ExecContext(ctx, stmt); err != nil {
+				return fmt.Errorf("goose: DDL statement failed: %w", err)
+			}
+			continue
+		}
+
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(stmt); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("goose: migration statement failed: %w", err)
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Up applies every migration in dir newer than the current version. The run
+// holds the current dialect's session lock for its duration (see
+// RunWithLock), so concurrent goose processes against the same database
+// (e.g. a Kubernetes rollout booting several instances at once) don't race
+// on the version table.
+func Up(db *sql.DB, dir string) error {
+	// Must run before the lock is acquired: sqlite3's lock inserts a
+	// sentinel row into the version table, so the table has to exist first.
+	if err := store.EnsureExists(db); err != nil {
+		return err
+	}
+
+	return RunWithLock(db, func(conn *sql.Conn) error {
+		files, err := collectMigrationFiles(dir)
+		if err != nil {
+			return err
+		}
+
+		current, err := store.Current(conn)
+		if err != nil {
+			return err
+		}
+
+		for _, f := range files {
+			if f.Version <= current {
+				if err := checkDrift(conn, f); err != nil {
+					return err
+				}
+				continue
+			}
+
+			body, err := ioutil.ReadFile(f.Source)
+			if err != nil {
+				return err
+			}
+			if err := runMigrationStatementsWithRetry(conn, upStatements(string(body))); err != nil {
+				return fmt.Errorf("goose: up %d failed: %w", f.Version, err)
+			}
+			if err := store.Insert(conn, f.Version, true, f.Checksum, appliedByIdentity()); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// Status reports, for every migration in dir, whether it has been applied,
+// re-hashing each file and comparing it against the recorded checksum so
+// drift in a previously-applied migration surfaces here too, not just on Up.
+func Status(db *sql.DB, dir string) error {
+	files, err := collectMigrationFiles(dir)
+	if err != nil {
+		return err
+	}
+
+	current, err := store.Current(db)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		applied := f.Version <= current
+		if applied {
+			if err := checkDrift(db, f); err != nil {
+				return err
+			}
+		}
+		fmt.Printf("%-8s %d\n", statusLabel(applied), f.Version)
+	}
+
+	return nil
+}
+
+func statusLabel(applied bool) string {
+	if applied {
+		return "applied"
+	}
+	return "pending"
+}
+
+// Down reverts the most recently applied migration in dir, holding the
+// current dialect's session lock for the duration of the run.
+func Down(db *sql.DB, dir string) error {
+	return RunWithLock(db, func(conn *sql.Conn) error {
+		current, err := store.Current(conn)
+		if err != nil {
+			return err
+		}
+		if current == 0 {
+			return nil
+		}
+
+		files, err := collectMigrationFiles(dir)
+		if err != nil {
+			return err
+		}
+
+		for _, f := range files {
+			if f.Version != current {
+				continue
+			}
+
+			body, err := ioutil.ReadFile(f.Source)
+			if err != nil {
+				return err
+			}
+			if err := runMigrationStatementsWithRetry(conn, downStatements(string(body))); err != nil {
+				return fmt.Errorf("goose: down %d failed: %w", f.Version, err)
+			}
+			return store.Delete(conn, f.Version)
+		}
+
+		return fmt.Errorf("goose: migration %d not found in %s", current, dir)
+	})
+}